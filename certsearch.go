@@ -5,20 +5,517 @@
 package main
 
 import (
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"math"
+	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/robstradling/CeRTSearcH/output"
 	"github.com/sirupsen/logrus"
 )
 
+// logSink preserves CeRTSearcH's original default behavior of logging each
+// matched record via logrus, for use when -output isn't given.
+type logSink struct{}
+
+func (logSink) Write(r output.Record) error {
+	logrus.WithFields(logrus.Fields{"certificate_id": r.CrtshID, "dns_name": r.Identity, "not_after": r.NotAfter}).Info("Record found")
+	return nil
+}
+func (logSink) Flush() error { return nil }
+func (logSink) Close() error { return nil }
+
+// outputFlag collects one or more repeated "-output" flags into a slice, so
+// results can fan out to multiple sinks.
+type outputFlag []string
+
+func (o *outputFlag) String() string { return strings.Join(*o, ",") }
+func (o *outputFlag) Set(spec string) error {
+	*o = append(*o, spec)
+	return nil
+}
+
+// querier is satisfied by both *pgxpool.Pool and a single *pgx.Conn, so the
+// query helpers below don't care whether they're called from a pooled
+// worker or directly against one connection.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// checkpoint records the highest crt.sh ID that has been fully processed,
+// plus a hash of the flag configuration that produced it, so -checkpointFile
+// can be trusted to resume the same search rather than silently continuing
+// a different one.
+type checkpoint struct {
+	HighWaterID int64  `json:"high_water_id"`
+	ConfigHash  string `json:"config_hash"`
+}
+
+// checkpointConfigHash identifies the logical search (as opposed to
+// performance knobs like -workers or -batchSize) that produced a checkpoint.
+func checkpointConfigHash(query, q string, endID int64) string {
+	sum := sha256.Sum256([]byte(query + "\x00" + q + "\x00" + strconv.FormatInt(endID, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// readCheckpoint loads a checkpoint previously written by writeCheckpoint.
+func readCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint atomically writes cp to path via write-temp-then-rename,
+// so a crash mid-write never leaves a corrupt or partial checkpoint behind.
+func writeCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// completionTracker tracks which [first,last] ID ranges have been accounted
+// for - fetched successfully, or given up on after a query error - and
+// reports the highest ID such that every range up to and including it has
+// been accounted for, even though ranges may finish out of order. A failed
+// range is marked complete the same as a successful one: the alternative
+// (never marking it complete) leaves every later range permanently unable
+// to join the contiguous run, freezing the checkpoint's high-water mark and
+// leaking pending for the rest of the run. The cost is that a resume from
+// checkpoint won't retry the one range that failed.
+type completionTracker struct {
+	expected int64
+	pending  map[int64]int64 // first -> last, for ranges not yet contiguous
+}
+
+func newCompletionTracker(startID int64) *completionTracker {
+	return &completionTracker{expected: startID, pending: make(map[int64]int64)}
+}
+
+// complete records that [first,last] is accounted for, successful or not,
+// and returns the new contiguous high-water mark (expected-1, i.e. nothing
+// new if first didn't extend the contiguous run).
+func (c *completionTracker) complete(first, last int64) int64 {
+	c.pending[first] = last
+	for {
+		l, ok := c.pending[c.expected]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.expected)
+		c.expected = l + 1
+	}
+	return c.expected - 1
+}
+
+// getCertificateQuery fetches the raw DER of a single certificate, used by
+// -savePath to avoid widening the main query for a column most invocations
+// don't need.
+const getCertificateQuery = `SELECT CERTIFICATE FROM certificate WHERE ID = $1`
+
+// fingerprintCache is a small in-memory LRU of SHA-256 fingerprints we've
+// already confirmed are saved, so -savePath doesn't re-stat disk for every
+// row of a certificate we've seen recently (e.g. a CN and several SANs from
+// the same row set). It also keeps a second LRU from certificateID to
+// fingerprint, so a row that repeats a certificateID we've already fetched
+// in this run (again, a CN and its SANs are the same certificate) skips the
+// getCertificateQuery round-trip entirely instead of just the disk stat.
+type fingerprintCache struct {
+	capacity int
+	mu       sync.Mutex
+	order    *list.List
+	index    map[string]*list.Element
+
+	certOrder *list.List
+	certIndex map[int64]*list.Element
+}
+
+// certIDEntry is the certOrder/certIndex payload: the certificateID is both
+// the map key and stored in the list element's value, so eviction can find it.
+type certIDEntry struct {
+	certificateID int64
+	fingerprint   string
+}
+
+func newFingerprintCache(capacity int) *fingerprintCache {
+	return &fingerprintCache{
+		capacity:  capacity,
+		order:     list.New(),
+		index:     make(map[string]*list.Element),
+		certOrder: list.New(),
+		certIndex: make(map[int64]*list.Element),
+	}
+}
+
+func (c *fingerprintCache) Contains(fingerprint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.index[fingerprint]
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (c *fingerprintCache) Add(fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[fingerprint]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.index[fingerprint] = c.order.PushFront(fingerprint)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.index, oldest.Value.(string))
+	}
+}
+
+// ContainsCertID reports whether certificateID's fingerprint is already
+// known from an earlier row in this run, returning it so the caller can
+// skip re-fetching the certificate's DER entirely.
+func (c *fingerprintCache) ContainsCertID(certificateID int64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.certIndex[certificateID]
+	if !ok {
+		return "", false
+	}
+	c.certOrder.MoveToFront(elem)
+	return elem.Value.(*certIDEntry).fingerprint, true
+}
+
+func (c *fingerprintCache) AddCertID(certificateID int64, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.certIndex[certificateID]; ok {
+		c.certOrder.MoveToFront(elem)
+		return
+	}
+	c.certIndex[certificateID] = c.certOrder.PushFront(&certIDEntry{certificateID: certificateID, fingerprint: fingerprint})
+	if c.certOrder.Len() > c.capacity {
+		oldest := c.certOrder.Back()
+		c.certOrder.Remove(oldest)
+		delete(c.certIndex, oldest.Value.(*certIDEntry).certificateID)
+	}
+}
+
+// saveCertificate fetches certificateID's DER from crt.sh and writes it
+// beneath savePath as "<sha256-fingerprint>.<ext>", skipping the query
+// entirely if we've already fetched this certificateID in this run (e.g. a
+// CN and several SANs from the same row set), and skipping the write if the
+// fingerprint is already known (via cache or disk).
+func saveCertificate(ctx context.Context, crtsh querier, cache *fingerprintCache, savePath, saveFormat string, certificateID int64) error {
+	if _, ok := cache.ContainsCertID(certificateID); ok {
+		return nil
+	}
+
+	var der []byte
+	if err := crtsh.QueryRow(ctx, getCertificateQuery, certificateID).Scan(&der); err != nil {
+		return err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	fingerprintHex := hex.EncodeToString(fingerprint[:])
+	cache.AddCertID(certificateID, fingerprintHex)
+	if cache.Contains(fingerprintHex) {
+		return nil
+	}
+
+	ext := "pem"
+	if saveFormat == "der" {
+		ext = "der"
+	} else if saveFormat == "json-with-parsed-fields" {
+		ext = "json"
+	}
+
+	path := filepath.Join(savePath, fingerprintHex+"."+ext)
+	if _, err := os.Stat(path); err == nil {
+		cache.Add(fingerprintHex)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var data []byte
+	var err error
+	switch saveFormat {
+	case "der":
+		data = der
+	case "json-with-parsed-fields":
+		data, err = certificateToJSON(der, fingerprintHex)
+	default:
+		data = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	cache.Add(fingerprintHex)
+	return nil
+}
+
+// certificateToJSON renders a handful of parsed fields alongside the
+// fingerprint, for -saveFormat=json-with-parsed-fields.
+func certificateToJSON(der []byte, fingerprintHex string) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(struct {
+		Fingerprint string    `json:"sha256_fingerprint"`
+		Subject     string    `json:"subject"`
+		Issuer      string    `json:"issuer"`
+		NotBefore   time.Time `json:"not_before"`
+		NotAfter    time.Time `json:"not_after"`
+		DNSNames    []string  `json:"dns_names"`
+	}{
+		Fingerprint: fingerprintHex,
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		DNSNames:    cert.DNSNames,
+	}, "", "  ")
+}
+
+// graphEdge describes one hop discovered while walking the domain graph:
+// identity "source" was found on certificate "certificate_id", which also
+// carries identity "discovered".
+type graphEdge struct {
+	Source        string `json:"source_identity"`
+	CertificateID int64  `json:"certificate_id"`
+	Discovered    string `json:"discovered_identity"`
+}
+
+// graphSiblingsQuery returns every Subject DN attribute and SAN carried by a
+// single certificate, regardless of -subjectType/-sanType, so that traversal
+// can pick up every potential next hop.
+const graphSiblingsQuery = `
+	SELECT encode(x509_nameattributes_raw.RAW_VALUE, 'escape'::text) AS IDENTITY
+		FROM certificate c, x509_nameattributes_raw(c.CERTIFICATE)
+		WHERE c.ID = $1
+	UNION
+	SELECT encode(x509_altnames_raw.RAW_VALUE, 'escape'::text) AS IDENTITY
+		FROM certificate c, x509_altnames_raw(c.CERTIFICATE)
+		WHERE c.ID = $1`
+
+// searchIdentity runs "query" over [startID,endID] in batches of batchSize,
+// binding "identity" as the $3 parameter, and returns the set of certificate
+// IDs on which it was found.
+func searchIdentity(ctx context.Context, crtsh querier, query string, startID, endID, batchSize int64, identity string) ([]int64, error) {
+	var certificateIDs []int64
+	seen := make(map[int64]bool)
+	for i := startID; i <= endID; i += batchSize {
+		last := i + batchSize - 1
+		if last > endID {
+			last = endID
+		}
+
+		rows, err := crtsh.Query(ctx, query, i, last, identity)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var certificateID int64
+			var name, identityType string
+			var notAfter time.Time
+			if err = rows.Scan(&certificateID, &name, &identityType, &notAfter); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if seen[certificateID] {
+				continue
+			}
+			seen[certificateID] = true
+			certificateIDs = append(certificateIDs, certificateID)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return certificateIDs, ctx.Err()
+		default:
+		}
+	}
+	return certificateIDs, nil
+}
+
+// graphSiblings returns every identity carried by certificateID, as found by
+// graphSiblingsQuery.
+func graphSiblings(ctx context.Context, crtsh querier, certificateID int64) ([]string, error) {
+	rows, err := crtsh.Query(ctx, graphSiblingsQuery, certificateID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []string
+	for rows.Next() {
+		var identity string
+		if err = rows.Scan(&identity); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// normalizeIdentity produces the key used to de-duplicate visited nodes and
+// detect cycles, independent of case.
+func normalizeIdentity(identity string) string {
+	return strings.ToLower(strings.TrimSuffix(identity, "."))
+}
+
+// runGraphMode treats seed as the root of a domain graph and transitively
+// re-runs the search against every SAN/CN it finds, up to graphDepth hops or
+// graphMaxNodes distinct identities, mirroring how certgraph walks from host
+// to host through certificate names.  It returns the discovered edges.
+func runGraphMode(ctx context.Context, crtsh querier, query string, startID, endID, batchSize int64, seed string, graphDepth int, graphMaxNodes int, graphConcurrency int) []graphEdge {
+	visited := map[string]bool{normalizeIdentity(seed): true}
+	frontier := []string{seed}
+	nodeCount := 1
+
+	var edges []graphEdge
+	sem := make(chan struct{}, graphConcurrency)
+
+	for depth := 0; depth <= graphDepth && len(frontier) > 0 && nodeCount < graphMaxNodes; depth++ {
+		type hop struct {
+			source     string
+			discovered []string
+			edges      []graphEdge
+		}
+		hops := make(chan hop, len(frontier))
+
+		var wg sync.WaitGroup
+		for _, identity := range frontier {
+			if nodeCount >= graphMaxNodes {
+				logrus.WithFields(logrus.Fields{"graphMaxNodes": graphMaxNodes}).Debug("graphMaxNodes reached; stopping traversal")
+				break
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(identity string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				certificateIDs, err := searchIdentity(ctx, crtsh, query, startID, endID, batchSize, identity)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{"identity": identity, "err": err}).Error("Graph traversal query failed")
+					return
+				}
+
+				var discovered []string
+				var localEdges []graphEdge
+				for _, certificateID := range certificateIDs {
+					siblings, err := graphSiblings(ctx, crtsh, certificateID)
+					if err != nil {
+						logrus.WithFields(logrus.Fields{"certificate_id": certificateID, "err": err}).Error("Could not fetch graph siblings")
+						continue
+					}
+					for _, sibling := range siblings {
+						localEdges = append(localEdges, graphEdge{Source: identity, CertificateID: certificateID, Discovered: sibling})
+						discovered = append(discovered, sibling)
+					}
+				}
+				hops <- hop{source: identity, discovered: discovered, edges: localEdges}
+			}(identity)
+		}
+		wg.Wait()
+		close(hops)
+
+		var nextFrontier []string
+		for h := range hops {
+			edges = append(edges, h.edges...)
+			for _, identity := range h.discovered {
+				key := normalizeIdentity(identity)
+				if visited[key] {
+					continue // Already visited: avoid cycles.
+				}
+				visited[key] = true
+				nodeCount++
+				nextFrontier = append(nextFrontier, identity)
+				if nodeCount >= graphMaxNodes {
+					break
+				}
+			}
+		}
+		frontier = nextFrontier
+	}
+
+	return edges
+}
+
+// writeGraphOutput renders edges as GraphViz DOT or as a JSONL edge list,
+// depending on format ("dot" or "jsonl").
+func writeGraphOutput(format string, path string, edges []graphEdge) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case "dot":
+		fmt.Fprintln(f, "digraph certsearch {")
+		for _, edge := range edges {
+			fmt.Fprintf(f, "\t%q -> %q [label=%q];\n", edge.Source, edge.Discovered, fmt.Sprintf("%d", edge.CertificateID))
+		}
+		fmt.Fprintln(f, "}")
+	case "jsonl":
+		encoder := json.NewEncoder(f)
+		for _, edge := range edges {
+			if err = encoder.Encode(edge); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown -graphOutput format %q", format)
+	}
+	return nil
+}
+
 func main() {
 	// Configure graceful shutdown capabilities.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
@@ -28,6 +525,15 @@ func main() {
 	var startID, endID, batchSize int64
 	var unexpiredOnly, deduplicate, uniq, sort, showSQLOnly bool
 	var q, subjectType, sanType, logLevel string
+	var graphMode bool
+	var graphDepth, graphMaxNodes, graphConcurrency int
+	var graphOutput string
+	var savePath, saveFormat string
+	var workers int
+	var outputs outputFlag
+	var checkpointFile string
+	var checkpointInterval int
+	var includeSubdomains, excludeSubdomains bool
 	flag.Int64Var(&startID, "startID", -1, "crt.sh ID to start from [-1 = stream new records, starting at max(ID)+1]")
 	flag.Int64Var(&endID, "endID", math.MaxInt64, "crt.sh ID to stop at")
 	flag.Int64Var(&batchSize, "batchSize", 100000, "Number of certificate records to process per batch")
@@ -40,6 +546,19 @@ func main() {
 	flag.StringVar(&subjectType, "subjectType", "NONE", "Subject DN attributes to search [NONE, ANY, <OID>]")
 	flag.StringVar(&sanType, "sanType", "dNSName", "Subject Alternative Name attributes to search [NONE, ANY, rfc822Name, dNSName, iPAddress]")
 	flag.StringVar(&logLevel, "logLevel", "debug", "Logging verbosity [debug, info, error, fatal]")
+	flag.BoolVar(&graphMode, "graph", false, "Treat -q as the seed of a domain graph and transitively search each discovered SAN/CN")
+	flag.IntVar(&graphDepth, "graphDepth", 2, "Maximum number of hops to take from the seed identity in -graph mode")
+	flag.IntVar(&graphMaxNodes, "graphMaxNodes", 1000, "Maximum number of distinct identities to visit in -graph mode")
+	flag.IntVar(&graphConcurrency, "graphConcurrency", 5, "Maximum number of identities to search concurrently in -graph mode")
+	flag.StringVar(&graphOutput, "graphOutput", "dot:graph.dot", "Where to write the discovered graph in -graph mode [\"dot:<path>\" or \"jsonl:<path>\"]")
+	flag.StringVar(&savePath, "savePath", "", "If set, save each matched certificate beneath this directory, named by its SHA-256 fingerprint")
+	flag.StringVar(&saveFormat, "saveFormat", "pem", "Format to save certificates in when -savePath is set [pem, der, json-with-parsed-fields]")
+	flag.IntVar(&workers, "workers", 4, "Number of batches to process concurrently")
+	flag.Var(&outputs, "output", "Where to send matched records [stdout-jsonl, stdout-csv, file:<path>, http-webhook:<url>, kafka:<broker>/<topic>] (repeatable; default: log via logrus as before)")
+	flag.StringVar(&checkpointFile, "checkpointFile", "", "If set, periodically save the highest fully-processed ID here, and resume from it on restart")
+	flag.IntVar(&checkpointInterval, "checkpointInterval", 10, "Number of successful batches between checkpoint saves")
+	flag.BoolVar(&includeSubdomains, "includeSubdomains", false, "Treat -q as a bare domain and also match its subdomains, instead of hand-crafting a wildcard")
+	flag.BoolVar(&excludeSubdomains, "excludeSubdomains", false, "Treat -q as a bare domain and match it exactly, excluding subdomains")
 	flag.Parse()
 
 	// Configure logrus.
@@ -64,6 +583,47 @@ func main() {
 		logrus.Fatal("batchSize must be <=100000")
 	} else if subjectType == "NONE" && sanType == "NONE" {
 		logrus.Fatal("subjectType and sanType cannot both be NONE")
+	} else if workers < 1 {
+		logrus.Fatal("workers must be >= 1")
+	} else if checkpointInterval < 1 {
+		logrus.Fatal("checkpointInterval must be >= 1")
+	} else if includeSubdomains && excludeSubdomains {
+		logrus.Fatal("-includeSubdomains and -excludeSubdomains are mutually exclusive")
+	} else if (includeSubdomains || excludeSubdomains) && graphMode {
+		logrus.Fatal("-includeSubdomains/-excludeSubdomains cannot be combined with -graph")
+	} else if (includeSubdomains || excludeSubdomains) && strings.ContainsAny(q, "%_") {
+		logrus.Fatal("-q must be a bare domain (no wildcards) when -includeSubdomains or -excludeSubdomains is used")
+	} else if graphMode && strings.ContainsAny(q, "%_") {
+		logrus.Fatal("-q must be a bare identity (no wildcards) when -graph is used")
+	} else if graphMode && graphDepth < 0 {
+		logrus.Fatal("graphDepth must be >= 0")
+	} else if graphMode && graphMaxNodes < 1 {
+		logrus.Fatal("graphMaxNodes must be >= 1")
+	} else if graphMode && graphConcurrency < 1 {
+		logrus.Fatal("graphConcurrency must be >= 1")
+	}
+
+	if savePath != "" {
+		switch saveFormat {
+		case "pem", "der", "json-with-parsed-fields":
+		default:
+			logrus.Fatal("Invalid saveFormat")
+		}
+		if err := os.MkdirAll(savePath, 0755); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal("Could not create savePath")
+		}
+	}
+
+	var graphFormat, graphOutputPath string
+	if graphMode {
+		parts := strings.SplitN(graphOutput, ":", 2)
+		if len(parts) != 2 {
+			logrus.Fatal("graphOutput must be of the form \"dot:<path>\" or \"jsonl:<path>\"")
+		}
+		graphFormat, graphOutputPath = parts[0], parts[1]
+		if graphFormat != "dot" && graphFormat != "jsonl" {
+			logrus.Fatal("graphOutput format must be \"dot\" or \"jsonl\"")
+		}
 	}
 
 	switch subjectType {
@@ -91,12 +651,12 @@ func main() {
 	}
 
 	// Construct the query.
-	query := `SELECT c.ID, name.IDENTITY, x509_notAfter(c.CERTIFICATE)
+	query := `SELECT c.ID, name.IDENTITY, name.IDENTITY_TYPE, x509_notAfter(c.CERTIFICATE)
 	FROM certificate c
 			LEFT JOIN LATERAL (`
 	if subjectType != "NONE" {
 		query += `
-				SELECT encode(x509_nameattributes_raw.RAW_VALUE, 'escape'::text) AS IDENTITY
+				SELECT encode(x509_nameattributes_raw.RAW_VALUE, 'escape'::text) AS IDENTITY, 'subject' AS IDENTITY_TYPE
 					FROM x509_nameattributes_raw(c.CERTIFICATE)`
 		if subjectType != "ANY" {
 			query += `
@@ -109,7 +669,7 @@ func main() {
 				UNION`
 		}
 		query += `
-				SELECT encode(x509_altnames_raw.RAW_VALUE, 'escape'::text) AS IDENTITY
+				SELECT encode(x509_altnames_raw.RAW_VALUE, 'escape'::text) AS IDENTITY, 'san' AS IDENTITY_TYPE
 					FROM x509_altnames_raw(c.CERTIFICATE)`
 		if sanType != "ANY" {
 			query += `
@@ -119,7 +679,16 @@ func main() {
 	query += `
 		   ) name ON TRUE
 	WHERE c.ID BETWEEN $1 AND $2`
-	if q != "" {
+	if includeSubdomains {
+		// Match "example.com" itself plus any ".example.com" subdomain,
+		// without falling back to a "%example.com" wildcard that would also
+		// match unrelated strings like "notexample.com".
+		query += `
+		AND (name.IDENTITY = $3 OR name.IDENTITY ILIKE $4)`
+	} else if excludeSubdomains {
+		query += `
+		AND name.IDENTITY = $3`
+	} else if q != "" {
 		query += `
 		AND name.IDENTITY ILIKE $3`
 	}
@@ -141,11 +710,11 @@ func main() {
 	}
 	if uniq {
 		query += `
-		GROUP BY c.ID, name.IDENTITY, x509_notAfter(c.CERTIFICATE)`
+		GROUP BY c.ID, name.IDENTITY, name.IDENTITY_TYPE, x509_notAfter(c.CERTIFICATE)`
 	}
 	if sort {
 		query += `
-		ORDER BY c.ID, name.IDENTITY, x509_notAfter(c.CERTIFICATE)`
+		ORDER BY c.ID, name.IDENTITY, name.IDENTITY_TYPE, x509_notAfter(c.CERTIFICATE)`
 	}
 
 	// If required, display the constructed SQL query then exit.
@@ -155,24 +724,145 @@ func main() {
 	}
 
 	// Parse the connect string URI.
-	var pgxConfig *pgx.ConnConfig
-	if pgxConfig, err = pgx.ParseConfig("postgresql:///certwatch?host=crt.sh&port=5432&application_name=CeRTSearcH&user=guest&statement_cache_mode=describe"); err != nil {
+	var pgxConfig *pgxpool.Config
+	if pgxConfig, err = pgxpool.ParseConfig("postgresql:///certwatch?host=crt.sh&port=5432&application_name=CeRTSearcH&user=guest&statement_cache_mode=describe"); err != nil {
 		logrus.WithFields(logrus.Fields{"err": err}).Fatal("Could not parse connect string URI")
 	}
+	// -graph mode throttles itself with -graphConcurrency instead of
+	// -workers, so size the pool off whichever of the two is actually in
+	// play; otherwise -graphConcurrency above the pool size just serializes
+	// behind connection checkout instead of giving the advertised
+	// concurrency.
+	poolConcurrency := workers
+	if graphMode {
+		poolConcurrency = graphConcurrency
+	}
+	pgxConfig.MaxConns = int32(poolConcurrency) + 2 // Leave headroom for the "latest ID" and -savePath lookups.
 
 	// Connect to crt.sh:5432.
-	var crtsh *pgx.Conn
-	if crtsh, err = pgx.ConnectConfig(context.Background(), pgxConfig); err != nil {
+	var crtsh *pgxpool.Pool
+	if crtsh, err = pgxpool.ConnectConfig(context.Background(), pgxConfig); err != nil {
 		logrus.WithFields(logrus.Fields{"err": err}).Fatal("Could not connect to crt.sh:5432")
 	}
-	defer crtsh.Close(context.Background())
+	defer crtsh.Close()
+
+	// -graph mode: walk the domain graph from the seed identity instead of
+	// running the usual batch/stream loop.
+	if graphMode {
+		graphStartID := startID
+		if graphStartID < 0 {
+			graphStartID = 0
+		}
+
+		// Unlike the main loop, -graph never tails max(ID): it always
+		// terminates once the traversal itself is exhausted. Clamp an
+		// unbounded -endID to the database's actual high-water mark so
+		// searchIdentity doesn't walk billions of empty batchSize-sized
+		// ranges for every discovered identity.
+		var maxCertificateID int64
+		if err = crtsh.QueryRow(context.Background(), "SELECT max(ID) FROM certificate").Scan(&maxCertificateID); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal("Could not obtain latest ID")
+		}
+		graphEndID := endID
+		if graphEndID > maxCertificateID {
+			graphEndID = maxCertificateID
+		}
+
+		edges := runGraphMode(ctx, crtsh, query, graphStartID, graphEndID, batchSize, q, graphDepth, graphMaxNodes, graphConcurrency)
+		logrus.WithFields(logrus.Fields{"edges": len(edges)}).Debug("Graph traversal complete")
+		if err = writeGraphOutput(graphFormat, graphOutputPath, edges); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal("Could not write graph output")
+		}
+		return
+	}
+
+	// If required, prepare the fingerprint cache used by -savePath to avoid
+	// redundant stat calls for certificates we've saved recently.
+	var fpCache *fingerprintCache
+	if savePath != "" {
+		fpCache = newFingerprintCache(10000)
+	}
+
+	// Build the output sink(s). With no -output given, fall back to the
+	// original logrus-based logging so default behavior is unchanged.
+	var sink output.Sink
+	if len(outputs) == 0 {
+		sink = logSink{}
+	} else {
+		sinks := make([]output.Sink, 0, len(outputs))
+		for _, spec := range outputs {
+			s, serr := output.New(spec)
+			if serr != nil {
+				logrus.WithFields(logrus.Fields{"output": spec, "err": serr}).Fatal("Invalid -output sink")
+			}
+			sinks = append(sinks, s)
+		}
+		sink = output.NewMulti(sinks)
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Could not close output sink")
+		}
+	}()
+
+	// If a matching checkpoint exists, resume from it regardless of
+	// -startID. A config hash mismatch (e.g. a different -q or -subjectType)
+	// means the checkpoint belongs to a different search, so it's ignored.
+	configHash := checkpointConfigHash(query, q, endID)
+	if checkpointFile != "" {
+		if cp, cpErr := readCheckpoint(checkpointFile); cpErr == nil {
+			if cp.ConfigHash == configHash {
+				startID = cp.HighWaterID + 1
+				logrus.WithFields(logrus.Fields{"resume_from": startID}).Info("Resuming from checkpoint")
+			} else {
+				logrus.Warn("Checkpoint found but its configuration doesn't match this invocation; ignoring it")
+			}
+		} else if !os.IsNotExist(cpErr) {
+			logrus.WithFields(logrus.Fields{"err": cpErr}).Fatal("Could not read checkpoint file")
+		}
+	}
+
+	// Resolve "stream new records" up front, so the writer below knows the
+	// true first ID to expect even before the producer has fetched its
+	// first batch.
+	if startID == -1 {
+		var maxCertificateID int64
+		if err = crtsh.QueryRow(context.Background(), "SELECT max(ID) FROM certificate").Scan(&maxCertificateID); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal("Could not obtain latest ID")
+		}
+		startID = maxCertificateID + 1
+	}
+
+	// Launch the worker pool: "jobs" hands out non-overlapping ID ranges,
+	// "results" carries each range's outcome back to the single writer
+	// goroutine below.  The jobs channel's capacity is the backpressure cap:
+	// the producer blocks rather than queueing more than 2*workers ranges.
+	jobs := make(chan idRange, 2*workers)
+	results := make(chan batchResult, 2*workers)
+
+	var workerWG sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		workerWG.Add(1)
+		go func() {
+			defer workerWG.Done()
+			runWorker(ctx, crtsh, query, q, includeSubdomains, jobs, results, savePath, saveFormat, fpCache)
+		}()
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		writeResults(results, sort, startID, sink, checkpointFile, checkpointInterval, configHash)
+	}()
 
-	// Main loop: repeatedly run the query to search batches of certificate records.
+	// Producer: repeatedly discover how much of [i,endID] is available and
+	// hand it out as batchSize-sized ranges.  When tailing max(ID) and
+	// nothing new has landed, idle instead of enqueueing empty ranges.
 	maxCertificateID := int64(-1)
-	var thisBatchSize int64
 	var sleepFor time.Duration
-for_loop:
-	for i := startID; i < endID; i += thisBatchSize {
+	i := startID
+producer_loop:
+	for i < endID {
 		if sleepFor > 0 {
 			logrus.WithFields(logrus.Fields{"sleep_for": sleepFor}).Debug("Sleeping")
 		}
@@ -181,7 +871,7 @@ for_loop:
 		case <-time.After(sleepFor):
 		case <-ctx.Done():
 			logrus.WithFields(logrus.Fields{"last": i - 1}).Debug("Interrupted")
-			break for_loop
+			break producer_loop
 		}
 
 		sleepFor = time.Second * 15
@@ -195,47 +885,204 @@ for_loop:
 				logrus.WithFields(logrus.Fields{"latest_id": maxCertificateID}).Debug("Obtained latest ID")
 			}
 
-			if i == -1 {
-				startID = maxCertificateID + 1
-				i = startID
-			}
 			if maxCertificateID > endID {
 				maxCertificateID = endID
 			}
 		}
 
-		if thisBatchSize = maxCertificateID - i + 1; thisBatchSize >= batchSize {
-			thisBatchSize = batchSize // Enforce the maximum batch size.
-			sleepFor = 0              // No need to sleep after this batch.
-		} else if thisBatchSize <= 0 {
-			logrus.Debug("No more certificates available yet")
+		available := maxCertificateID - i + 1
+		if available <= 0 {
+			logrus.Debug("No more certificates available yet; workers idle")
 			continue
 		}
 
-		logrus.WithFields(logrus.Fields{"first": i, "last": i + thisBatchSize - 1}).Debug("Batch start")
+		for available > 0 {
+			thisBatchSize := batchSize
+			if thisBatchSize > available {
+				thisBatchSize = available
+			}
 
-		// Get batch of results.
-		var rows pgx.Rows
-		if rows, err = crtsh.Query(context.Background(), query, i, i+thisBatchSize-1, q); err != nil {
-			logrus.WithFields(logrus.Fields{"err": err}).Error("Could not obtain batch of results")
-			continue
+			r := idRange{first: i, last: i + thisBatchSize - 1}
+			logrus.WithFields(logrus.Fields{"first": r.first, "last": r.last}).Debug("Batch start")
+
+			select {
+			case jobs <- r:
+				i += thisBatchSize
+				available -= thisBatchSize
+				if thisBatchSize >= batchSize {
+					sleepFor = 0 // No need to sleep: there may be more to enqueue immediately.
+				}
+			case <-ctx.Done():
+				logrus.WithFields(logrus.Fields{"last": i - 1}).Debug("Interrupted")
+				break producer_loop
+			}
 		}
-		defer rows.Close()
+	}
 
-		// Process results.
-		var n int64
-		var certificateID int64
-		var dNSName string
-		var notAfter time.Time
-		for rows.Next() {
-			if err = rows.Scan(&certificateID, &dNSName, &notAfter); err != nil {
-				logrus.WithFields(logrus.Fields{"err": err}).Error("Could not scan result")
-				break for_loop
+	close(jobs)
+	workerWG.Wait()
+	close(results)
+	<-writerDone
+}
+
+// idRange is a non-overlapping [first,last] crt.sh ID range handed from the
+// producer to a worker.
+type idRange struct {
+	first, last int64
+}
+
+// batchResult is a worker's outcome for one idRange: either the matched
+// records, or the error that prevented fetching them.
+type batchResult struct {
+	first, last int64
+	records     []record
+	err         error
+}
+
+// record is a single matched (ID, identity, identityType, notAfter) row.
+type record struct {
+	certificateID int64
+	identity      string
+	identityType  string
+	notAfter      time.Time
+}
+
+// runWorker repeatedly takes an idRange from jobs, runs "query" against it,
+// optionally saves each matched certificate, and pushes the outcome to
+// results. It returns once jobs is closed and drained.
+func runWorker(ctx context.Context, crtsh querier, query, q string, includeSubdomains bool, jobs <-chan idRange, results chan<- batchResult, savePath, saveFormat string, fpCache *fingerprintCache) {
+	for r := range jobs {
+		records, err := fetchBatch(ctx, crtsh, query, q, includeSubdomains, r.first, r.last)
+		if err == nil && savePath != "" {
+			for _, rec := range records {
+				if serr := saveCertificate(ctx, crtsh, fpCache, savePath, saveFormat, rec.certificateID); serr != nil {
+					logrus.WithFields(logrus.Fields{"certificate_id": rec.certificateID, "err": serr}).Error("Could not save certificate")
+				}
 			}
+		}
 
-			logrus.WithFields(logrus.Fields{"certificate_id": certificateID, "dns_name": dNSName, "not_after": notAfter}).Info("Record found")
+		select {
+		case results <- batchResult{first: r.first, last: r.last, records: records, err: err}:
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		logrus.WithFields(logrus.Fields{"first": i, "last": i + thisBatchSize - 1, "count": n}).Debug("Batch end")
+// fetchBatch runs "query" over [first,last] and returns the matched records.
+// When includeSubdomains is set, query has an extra "%.<q>" placeholder
+// ($4) alongside the bare-domain match ($3); otherwise q alone fills $3.
+func fetchBatch(ctx context.Context, crtsh querier, query, q string, includeSubdomains bool, first, last int64) ([]record, error) {
+	var rows pgx.Rows
+	var err error
+	if includeSubdomains {
+		rows, err = crtsh.Query(ctx, query, first, last, q, "%."+q)
+	} else {
+		rows, err = crtsh.Query(ctx, query, first, last, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []record
+	for rows.Next() {
+		var rec record
+		if err = rows.Scan(&rec.certificateID, &rec.identity, &rec.identityType, &rec.notAfter); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// writeResults is the single consumer of the worker pool's results channel.
+// When sort is set it buffers out-of-order ranges and only emits them once
+// every preceding range (starting from expectedFirst) has arrived, so output
+// stays in crt.sh ID order even though ranges complete out of order. It also
+// maintains the checkpoint (if checkpointFile is set), independently of
+// -sort, saving every checkpointInterval successful batches and once more
+// when results is closed (covering both normal exit and graceful shutdown).
+func writeResults(results <-chan batchResult, sort bool, expectedFirst int64, sink output.Sink, checkpointFile string, checkpointInterval int, configHash string) {
+	pending := make(map[int64]batchResult)
+	tracker := newCompletionTracker(expectedFirst)
+	sinceCheckpoint := 0
+
+	saveCheckpoint := func() {
+		if checkpointFile == "" {
+			return
+		}
+		highWaterID := tracker.expected - 1
+		if highWaterID < expectedFirst {
+			return // Nothing has completed yet.
+		}
+		if err := writeCheckpoint(checkpointFile, checkpoint{HighWaterID: highWaterID, ConfigHash: configHash}); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Could not write checkpoint")
+		}
+	}
+
+	for res := range results {
+		if res.err != nil {
+			logrus.WithFields(logrus.Fields{"first": res.first, "last": res.last, "err": res.err}).Error("Could not obtain batch of results; giving up on this range")
+			res.records = nil // Nothing to emit for this range.
+		}
+
+		// Every range is accounted for here, successful or not, so the
+		// checkpoint high-water mark keeps advancing instead of freezing
+		// behind a range that failed.
+		tracker.complete(res.first, res.last)
+		if res.err == nil {
+			sinceCheckpoint++
+		}
+		if sinceCheckpoint >= checkpointInterval {
+			saveCheckpoint()
+			sinceCheckpoint = 0
+		}
+
+		if res.err != nil && !sort {
+			continue // Nothing to emit; -sort still needs it below to unblock ranges behind it.
+		}
+
+		if !sort {
+			emitBatch(res, sink)
+			continue
+		}
+
+		pending[res.first] = res
+		for {
+			next, ok := pending[expectedFirst]
+			if !ok {
+				break
+			}
+			emitBatch(next, sink)
+			delete(pending, expectedFirst)
+			expectedFirst = next.last + 1
+		}
+	}
+
+	saveCheckpoint()
+}
+
+// emitBatch dispatches every record in res through sink, followed by the
+// repo's existing "Batch end" summary line.
+func emitBatch(res batchResult, sink output.Sink) {
+	now := time.Now()
+	for _, rec := range res.records {
+		r := output.Record{
+			CrtshID:      rec.certificateID,
+			Identity:     rec.identity,
+			IdentityType: rec.identityType,
+			NotAfter:     rec.notAfter,
+			BatchFirst:   res.first,
+			BatchLast:    res.last,
+			DiscoveredAt: now,
+		}
+		if err := sink.Write(r); err != nil {
+			logrus.WithFields(logrus.Fields{"certificate_id": rec.certificateID, "err": err}).Error("Could not write record to output sink")
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Error("Could not flush output sink")
 	}
+	logrus.WithFields(logrus.Fields{"first": res.first, "last": res.last, "count": len(res.records)}).Debug("Batch end")
 }
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCompletionTrackerAdvancesInOrder(t *testing.T) {
+	tr := newCompletionTracker(100)
+
+	if hw := tr.complete(100, 109); hw != 109 {
+		t.Fatalf("expected high-water 109, got %d", hw)
+	}
+	if hw := tr.complete(110, 119); hw != 119 {
+		t.Fatalf("expected high-water 119, got %d", hw)
+	}
+}
+
+func TestCompletionTrackerBuffersOutOfOrderRanges(t *testing.T) {
+	tr := newCompletionTracker(100)
+
+	// The second range arrives before the first: the high-water mark can't
+	// move past 99 until [100,109] is also accounted for.
+	if hw := tr.complete(110, 119); hw != 99 {
+		t.Fatalf("expected high-water to stay at 99, got %d", hw)
+	}
+	if hw := tr.complete(100, 109); hw != 119 {
+		t.Fatalf("expected high-water to jump to 119 once the gap is filled, got %d", hw)
+	}
+}
+
+func TestCompletionTrackerAdvancesPastAFailedRange(t *testing.T) {
+	tr := newCompletionTracker(100)
+
+	// A failed range is accounted for the same as a successful one, so a
+	// single hiccup can't freeze the high-water mark or leak pending
+	// entries for the rest of the run.
+	if hw := tr.complete(100, 109); hw != 109 {
+		t.Fatalf("expected high-water 109, got %d", hw)
+	}
+	if hw := tr.complete(110, 119); hw != 119 {
+		t.Fatalf("expected high-water to advance past the failed range, got %d", hw)
+	}
+	if len(tr.pending) != 0 {
+		t.Fatalf("expected no leftover pending entries, got %d", len(tr.pending))
+	}
+}
@@ -0,0 +1,112 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// fileSink writes newline-delimited JSON records to path, rotating to
+// "<path>.N" once the current file reaches maxBytes or maxRecords (either
+// limit disabled by passing 0), and keeping at most maxFiles rotated files.
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxRecords int64
+	maxFiles   int
+
+	f       *os.File
+	written int64
+	records int64
+}
+
+// NewFile returns a Sink backed by path, for the "file:<path>" sink.
+func NewFile(path string, maxBytes, maxRecords int64, maxFiles int) (Sink, error) {
+	s := &fileSink{path: path, maxBytes: maxBytes, maxRecords: maxRecords, maxFiles: maxFiles}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.written = info.Size()
+	s.records = 0
+	return nil
+}
+
+func (s *fileSink) Write(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if (s.maxBytes > 0 && s.written >= s.maxBytes) || (s.maxRecords > 0 && s.records >= s.maxRecords) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	n, err := s.f.Write(data)
+	s.written += int64(n)
+	s.records++
+	return err
+}
+
+// rotate closes the current file, shifts "<path>.1".."<path>.N-1" up by one
+// (dropping anything that would fall off the end), and reopens path fresh.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	for n := s.maxFiles - 1; n >= 1; n-- {
+		src := s.rotatedPath(n)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if n+1 > s.maxFiles {
+			os.Remove(src)
+		} else {
+			os.Rename(src, s.rotatedPath(n+1))
+		}
+	}
+
+	if err := os.Rename(s.path, s.rotatedPath(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+func (s *fileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Sync()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
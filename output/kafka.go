@@ -0,0 +1,36 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// kafkaSink publishes each record as a single JSON message to a Kafka
+// topic, for the "kafka:<broker>/<topic>" sink.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// NewKafka returns a Sink that publishes to topic on broker.
+func NewKafka(broker, topic string) Sink {
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(broker),
+			Topic:    topic,
+			Balancer: &kafka.LeastBytes{},
+		},
+	}
+}
+
+func (s *kafkaSink) Write(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.writer.WriteMessages(context.Background(), kafka.Message{Value: data})
+}
+
+func (s *kafkaSink) Flush() error { return nil }
+func (s *kafkaSink) Close() error { return s.writer.Close() }
@@ -0,0 +1,93 @@
+package output
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// New constructs the Sink named by spec:
+//
+//	stdout-jsonl
+//	stdout-csv
+//	file:<path>[,maxBytes][,maxRecords][,maxFiles]
+//	http-webhook:<url>[,batchSize]
+//	kafka:<broker>/<topic>
+func New(spec string) (Sink, error) {
+	switch {
+	case spec == "stdout-jsonl":
+		return NewStdoutJSONL(os.Stdout), nil
+	case spec == "stdout-csv":
+		return NewStdoutCSV(os.Stdout), nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileFromSpec(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "http-webhook:"):
+		return newWebhookFromSpec(strings.TrimPrefix(spec, "http-webhook:"))
+	case strings.HasPrefix(spec, "kafka:"):
+		return newKafkaFromSpec(strings.TrimPrefix(spec, "kafka:"))
+	default:
+		return nil, fmt.Errorf("unknown -output sink %q", spec)
+	}
+}
+
+func newFileFromSpec(spec string) (Sink, error) {
+	parts := strings.Split(spec, ",")
+	if parts[0] == "" {
+		return nil, fmt.Errorf("file sink requires a path")
+	}
+
+	maxBytes := int64(100 * 1024 * 1024) // 100MiB default.
+	maxRecords := int64(0)
+	maxFiles := 5
+
+	if len(parts) > 1 && parts[1] != "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file sink maxBytes: %w", err)
+		}
+		maxBytes = n
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		n, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file sink maxRecords: %w", err)
+		}
+		maxRecords = n
+	}
+	if len(parts) > 3 && parts[3] != "" {
+		n, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid file sink maxFiles: %w", err)
+		}
+		maxFiles = n
+	}
+
+	return NewFile(parts[0], maxBytes, maxRecords, maxFiles)
+}
+
+func newWebhookFromSpec(spec string) (Sink, error) {
+	parts := strings.SplitN(spec, ",", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("http-webhook sink requires a URL")
+	}
+
+	batchSize := 100
+	if len(parts) > 1 && parts[1] != "" {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid http-webhook sink batchSize: %w", err)
+		}
+		batchSize = n
+	}
+
+	return NewHTTPWebhook(parts[0], batchSize), nil
+}
+
+func newKafkaFromSpec(spec string) (Sink, error) {
+	idx := strings.LastIndex(spec, "/")
+	if idx < 0 {
+		return nil, fmt.Errorf("kafka sink must be of the form <broker>/<topic>, got %q", spec)
+	}
+	return NewKafka(spec[:idx], spec[idx+1:]), nil
+}
@@ -0,0 +1,80 @@
+// Package output provides pluggable destinations for matched certificate
+// records, so CeRTSearcH can be used as a pipeline component instead of
+// something you grep logs from.
+package output
+
+import (
+	"errors"
+	"time"
+)
+
+// Record is the stable schema emitted to every configured Sink for each
+// matched certificate.
+type Record struct {
+	CrtshID      int64     `json:"crtsh_id"`
+	Identity     string    `json:"identity"`
+	IdentityType string    `json:"identity_type"`
+	NotAfter     time.Time `json:"not_after"`
+	BatchFirst   int64     `json:"batch_first"`
+	BatchLast    int64     `json:"batch_last"`
+	DiscoveredAt time.Time `json:"discovered_at"`
+}
+
+// Sink is implemented by every destination CeRTSearcH can dispatch matched
+// records to. Flush is called after each batch; Close is called once, on
+// shutdown.
+type Sink interface {
+	Write(Record) error
+	Flush() error
+	Close() error
+}
+
+// multiSink fans a single Write/Flush/Close out to every configured sink,
+// so results can go to more than one destination at once.
+type multiSink struct {
+	sinks []Sink
+}
+
+// NewMulti combines sinks into one Sink that dispatches to all of them. If
+// only one sink is given, it's returned unwrapped.
+func NewMulti(sinks []Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return &multiSink{sinks: sinks}
+}
+
+// Write dispatches r to every sink, even if an earlier one errors, so one
+// failing sink (e.g. a webhook that's briefly down) can't stop the record
+// from reaching the rest. Every error is combined into the return value.
+func (m *multiSink) Write(r Record) error {
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.Write(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *multiSink) Flush() error {
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink, even if an earlier one errors, so a failing
+// sink can't leave later ones (e.g. an open file handle) never closed.
+func (m *multiSink) Close() error {
+	var errs []error
+	for _, s := range m.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
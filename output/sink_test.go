@@ -0,0 +1,70 @@
+package output
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeSink is a minimal Sink whose Write/Flush/Close calls are counted and
+// can be made to fail, for exercising multiSink's fan-out behavior.
+type fakeSink struct {
+	writeErr, flushErr, closeErr error
+	writes, flushes, closes      int
+}
+
+func (f *fakeSink) Write(Record) error { f.writes++; return f.writeErr }
+func (f *fakeSink) Flush() error       { f.flushes++; return f.flushErr }
+func (f *fakeSink) Close() error       { f.closes++; return f.closeErr }
+
+func TestMultiSinkFansOutPastAFailingSink(t *testing.T) {
+	failing := &fakeSink{writeErr: errors.New("boom")}
+	healthy := &fakeSink{}
+	m := NewMulti([]Sink{failing, healthy})
+
+	err := m.Write(Record{CrtshID: 1})
+	if err == nil {
+		t.Fatal("expected Write to return the failing sink's error")
+	}
+	if failing.writes != 1 || healthy.writes != 1 {
+		t.Fatalf("expected both sinks to be written to, got failing=%d healthy=%d", failing.writes, healthy.writes)
+	}
+}
+
+func TestMultiSinkCloseClosesEverySink(t *testing.T) {
+	failing := &fakeSink{closeErr: errors.New("boom")}
+	healthy := &fakeSink{}
+	m := NewMulti([]Sink{failing, healthy})
+
+	err := m.Close()
+	if err == nil {
+		t.Fatal("expected Close to return the failing sink's error")
+	}
+	if failing.closes != 1 || healthy.closes != 1 {
+		t.Fatalf("expected both sinks to be closed, got failing=%d healthy=%d", failing.closes, healthy.closes)
+	}
+}
+
+func TestMultiSinkSingleSinkIsUnwrapped(t *testing.T) {
+	only := &fakeSink{}
+	if s := NewMulti([]Sink{only}); s != Sink(only) {
+		t.Fatal("expected NewMulti to return the sole sink unwrapped")
+	}
+}
+
+func TestCSVSinkFlushReachesTheUnderlyingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStdoutCSV(&buf)
+
+	if err := s.Write(Record{CrtshID: 1, Identity: "example.com"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "example.com") {
+		t.Fatalf("expected flushed row in underlying writer, got %q", buf.String())
+	}
+}
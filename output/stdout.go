@@ -0,0 +1,59 @@
+package output
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// jsonlSink writes one JSON object per record to an underlying writer, for
+// the "stdout-jsonl" sink.
+type jsonlSink struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewStdoutJSONL returns a Sink that writes newline-delimited JSON to w.
+func NewStdoutJSONL(w io.Writer) Sink {
+	bw := bufio.NewWriter(w)
+	return &jsonlSink{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (s *jsonlSink) Write(r Record) error { return s.enc.Encode(r) }
+func (s *jsonlSink) Flush() error         { return s.w.Flush() }
+func (s *jsonlSink) Close() error         { return s.Flush() }
+
+// csvSink writes one CSV row per record, for the "stdout-csv" sink. csv.Writer
+// already buffers internally, so w is passed to it directly rather than
+// wrapping it in another bufio.Writer whose buffer Flush/Close would never
+// drain.
+type csvSink struct {
+	cw *csv.Writer
+}
+
+// NewStdoutCSV returns a Sink that writes CSV rows to w.
+func NewStdoutCSV(w io.Writer) Sink {
+	return &csvSink{cw: csv.NewWriter(w)}
+}
+
+func (s *csvSink) Write(r Record) error {
+	return s.cw.Write([]string{
+		strconv.FormatInt(r.CrtshID, 10),
+		r.Identity,
+		r.IdentityType,
+		r.NotAfter.UTC().Format(time.RFC3339),
+		strconv.FormatInt(r.BatchFirst, 10),
+		strconv.FormatInt(r.BatchLast, 10),
+		r.DiscoveredAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *csvSink) Flush() error {
+	s.cw.Flush()
+	return s.cw.Error()
+}
+
+func (s *csvSink) Close() error { return s.Flush() }
@@ -0,0 +1,87 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookSink batches records and POSTs them as a JSON array to a URL,
+// retrying with exponential backoff if the request fails or the endpoint
+// returns a non-2xx status.
+type webhookSink struct {
+	url        string
+	batchSize  int
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+
+	mu      sync.Mutex
+	pending []Record
+}
+
+// NewHTTPWebhook returns a Sink that POSTs batches of batchSize records to
+// url, for the "http-webhook:<url>" sink.
+func NewHTTPWebhook(url string, batchSize int) Sink {
+	return &webhookSink{
+		url:        url,
+		batchSize:  batchSize,
+		maxRetries: 5,
+		backoff:    500 * time.Millisecond,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *webhookSink) Write(r Record) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, r)
+	shouldFlush := len(s.pending) >= s.batchSize
+	s.mu.Unlock()
+
+	if shouldFlush {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *webhookSink) Flush() error {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	backoff := s.backoff
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook %s returned status %d", s.url, resp.StatusCode)
+	}
+	return lastErr
+}
+
+func (s *webhookSink) Close() error { return s.Flush() }